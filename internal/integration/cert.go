@@ -0,0 +1,101 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package integration
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"time"
+)
+
+// selfSigned generates a self-signed certificate/key pair for the given
+// hostname for use in tests.
+func selfSigned(name string) (tls.Certificate, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	_, err = x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert := tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  priv,
+	}
+	cert.Leaf, err = x509.ParseCertificate(der)
+	return cert, err
+}
+
+// GenCert generates a self-signed certificate/key pair for name, the same way
+// Cert does, but without attaching it to a command.
+//
+// It exists for cases like the federation harness where certificate material
+// has to be generated and shared between commands (eg. cross-installed into
+// one another's CA bundle) before any of those commands exist to attach it
+// to; install the result on a command with UseCert.
+func GenCert(name string) (tls.Certificate, error) {
+	return selfSigned(name)
+}
+
+// UseCert installs a certificate generated with GenCert, writing it to the
+// command's temporary config directory the same way Cert does, but without
+// generating a new one.
+func UseCert(name string, cert tls.Certificate) Option {
+	return func(cmd *Cmd) error {
+		cmd.certs = append(cmd.certs, cert)
+		return writeCert(cmd, name, cert)
+	}
+}
+
+// writeCert writes the certificate and key for name to the command's
+// temporary config directory as name.crt and name.key.
+func writeCert(cmd *Cmd, name string, cert tls.Certificate) error {
+	keyBytes, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		return err
+	}
+	keyOut, err := os.Create(cmd.dir + "/" + name + ".key")
+	if err != nil {
+		return err
+	}
+	defer keyOut.Close()
+	if err := pem.Encode(keyOut, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}); err != nil {
+		return err
+	}
+
+	certOut, err := os.Create(cmd.dir + "/" + name + ".crt")
+	if err != nil {
+		return err
+	}
+	defer certOut.Close()
+	return pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+}
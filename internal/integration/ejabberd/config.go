@@ -0,0 +1,59 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package ejabberd
+
+import "text/template"
+
+// Config contains options that can be written to an ejabberd.yml config
+// file.
+type Config struct {
+	VHosts         []string
+	Modules        []string
+	C2SEnabled     bool
+	S2SEnabled     bool
+	C2SPort        int
+	S2SPort        int
+	S2SUseStarttls string
+
+	// ReadySocket is the path to the Unix domain socket that mod_ready
+	// connects back to once ejabberd has started. It is rendered as a
+	// mod_ready module option rather than a global option, since ejabberd
+	// rejects global config keys a module hasn't registered.
+	ReadySocket string
+}
+
+var cfgTmpl = template.Must(template.New(cfgFileName).Parse(`
+loglevel: info
+log_rotate_size: 0
+hosts:
+{{range .VHosts}}  - "{{.}}"
+{{end}}
+
+listen:
+{{if .C2SEnabled}}  -
+    port: {{.C2SPort}}
+    module: ejabberd_c2s
+{{end}}{{if .S2SEnabled}}  -
+    port: {{.S2SPort}}
+    module: ejabberd_s2s_in
+{{end}}
+
+{{if .S2SUseStarttls}}s2s_use_starttls: {{.S2SUseStarttls}}
+{{end}}
+
+modules:
+{{range .Modules}}{{if eq . "mod_ready"}}  mod_ready:
+    ready_socket: "{{$.ReadySocket}}"
+{{else}}  {{.}}: {}
+{{end}}{{end}}
+
+{{range .VHosts}}
+host_config:
+  "{{.}}":
+    certfiles:
+      - "{{$.ConfigDir}}/{{.}}.crt"
+      - "{{$.ConfigDir}}/{{.}}.key"
+{{end}}
+`))
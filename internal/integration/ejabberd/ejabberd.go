@@ -0,0 +1,301 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package ejabberd facilitates integration testing against ejabberd.
+package ejabberd // import "mellium.im/xmpp/internal/integration/ejabberd"
+
+import (
+	"context"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"mellium.im/xmpp/internal/integration"
+	"mellium.im/xmpp/jid"
+)
+
+const (
+	cfgFileName = "ejabberd.yml"
+	cmdName     = "ejabberdctl"
+	configFlag  = "--config"
+)
+
+// New creates a new, unstarted ejabberd daemon.
+//
+// The provided context is used to kill the process (by calling
+// os.Process.Kill) if the context becomes done before the command completes
+// on its own.
+//
+// Unlike Prosody, ejabberd is always started through ejabberdctl, so New
+// arranges for the daemon to run in the foreground.
+func New(ctx context.Context, opts ...integration.Option) (*integration.Cmd, error) {
+	opts = append(opts, integration.Args("foreground"))
+	return integration.New(
+		ctx, cmdName,
+		opts...,
+	)
+}
+
+// ConfigFile is an option that can be used to write a temporary ejabberd
+// config file.
+// This will overwrite the existing config file and make most of the other
+// options in this package noops.
+// This option only exists for the rare occasion that you need complete
+// control over the config file.
+func ConfigFile(cfg Config) integration.Option {
+	return func(cmd *integration.Cmd) error {
+		cmd.Config = cfg
+		err := integration.TempFile(cfgFileName, func(cmd *integration.Cmd, w io.Writer) error {
+			return cfgTmpl.Execute(w, struct {
+				Config
+				ConfigDir string
+			}{
+				Config:    cfg,
+				ConfigDir: cmd.ConfigDir(),
+			})
+		})(cmd)
+		if err != nil {
+			return err
+		}
+		cfgFilePath := filepath.Join(cmd.ConfigDir(), cfgFileName)
+		return integration.Args(configFlag, cfgFilePath)(cmd)
+	}
+}
+
+// Ctl returns an option that calls ejabberdctl with the provided args.
+// It automatically points ejabberdctl at the config file so there is no need
+// to pass the --config option.
+func Ctl(ctx context.Context, args ...string) integration.Option {
+	return integration.Defer(func(cmd *integration.Cmd) error {
+		cfgFilePath := filepath.Join(cmd.ConfigDir(), cfgFileName)
+		/* #nosec */
+		ctl := exec.CommandContext(ctx, cmdName, configFlag, cfgFilePath)
+		ctl.Args = append(ctl.Args, args...)
+		return ctl.Run()
+	})
+}
+
+func getConfig(cmd *integration.Cmd) Config {
+	if cmd.Config == nil {
+		cmd.Config = Config{}
+	}
+	return cmd.Config.(Config)
+}
+
+// ListenC2S listens for client-to-server (c2s) connections.
+// ejabberd is told to bind a free port itself and report back which port it
+// chose; see mod_ready.
+func ListenC2S() integration.Option {
+	return func(cmd *integration.Cmd) error {
+		cfg := getConfig(cmd)
+		cfg.C2SEnabled = true
+		cmd.Config = cfg
+		return installReady(cmd)
+	}
+}
+
+// ListenS2S listens for server-to-server (s2s) connections.
+// ejabberd is told to bind a free port itself and report back which port it
+// chose; see mod_ready.
+func ListenS2S() integration.Option {
+	return func(cmd *integration.Cmd) error {
+		cfg := getConfig(cmd)
+		cfg.S2SEnabled = true
+		cmd.Config = cfg
+		return installReady(cmd)
+	}
+}
+
+// installReady ensures the ready socket exists, records its path in the
+// config, and installs the bundled mod_ready erlang module that reports back
+// the ports ejabberd actually bound once it has started.
+func installReady(cmd *integration.Cmd) error {
+	cfg := getConfig(cmd)
+	if cfg.ReadySocket == "" {
+		path, err := cmd.ReadySocket()
+		if err != nil {
+			return err
+		}
+		cfg.ReadySocket = path
+		cmd.Config = cfg
+		err = Modules("mod_ready")(cmd)
+		if err != nil {
+			return err
+		}
+	}
+	return integration.TempFile("mod_ready.erl", func(_ *integration.Cmd, w io.Writer) error {
+		_, err := io.WriteString(w, `-module(mod_ready).
+-behaviour(gen_mod).
+
+-export([start/2, stop/1, mod_opt_type/1, mod_options/1, depends/2]).
+-export([started/0]).
+
+%% ready_socket isn't a registered ejabberd global option, so it's passed in
+%% as this module's own option and stashed in a persistent_term for started/0
+%% (which runs off of a global hook with no access to Opts) to pick back up.
+start(_Host, Opts) ->
+	persistent_term:put({?MODULE, ready_socket}, gen_mod:get_opt(ready_socket, Opts)),
+	ejabberd_hooks:add(started_hook, ?MODULE, started, 10).
+
+stop(_Host) ->
+	ejabberd_hooks:delete(started_hook, ?MODULE, started, 10),
+	persistent_term:erase({?MODULE, ready_socket}).
+
+%% Connects back to the ready_socket passed in as a module option and reports
+%% every c2s/s2s port ejabberd actually bound, mirroring Prosody's mod_ready.
+started() ->
+	ReadySocket = persistent_term:get({?MODULE, ready_socket}, undefined),
+	case ReadySocket of
+		undefined -> ok;
+		_ ->
+			{ok, Sock} = gen_tcp:connect({local, ReadySocket}, 0, [local, binary]),
+			lists:foreach(
+				fun({{Port, _IP, _Transport}, Module, _Opts}) ->
+					case proto_name(Module) of
+						undefined -> ok;
+						Name ->
+							gen_tcp:send(Sock, [Name, " 127.0.0.1:", integer_to_list(Port), "\n"])
+					end
+				end,
+				ejabberd_listener:listeners_running()),
+			gen_tcp:close(Sock)
+	end.
+
+%% listeners_running/0 reports the module actually handling each listener
+%% (eg. ejabberd_c2s, ejabberd_s2s_in), not a friendly name, so translate it to
+%% the protocol tag integration.Cmd.waitReady expects.
+proto_name(ejabberd_c2s) -> "c2s";
+proto_name(ejabberd_s2s_in) -> "s2s";
+proto_name(_) -> undefined.
+
+depends(_Host, _Opts) -> [].
+mod_opt_type(ready_socket) -> econf:string().
+mod_options(_Host) -> [{ready_socket, undefined}].
+`)
+		return err
+	})(cmd)
+}
+
+// VHost configures one or more virtual hosts.
+// The default if this option is not provided is to create a single vhost
+// called "localhost" and create a self-signed cert for it (if VHost is
+// specified certs must be manually created).
+func VHost(hosts ...string) integration.Option {
+	return func(cmd *integration.Cmd) error {
+		cfg := getConfig(cmd)
+		cfg.VHosts = append(cfg.VHosts, hosts...)
+		cmd.Config = cfg
+		return nil
+	}
+}
+
+// CreateUser returns an option that calls ejabberdctl to create a user.
+// It is equivalent to calling:
+// Ctl(ctx, "register", "localpart", "domainpart", "password") except that it
+// also configures the underlying Cmd to know about the user.
+func CreateUser(ctx context.Context, addr, pass string) integration.Option {
+	return func(cmd *integration.Cmd) error {
+		j, err := jid.Parse(addr)
+		if err != nil {
+			return err
+		}
+		err = Ctl(ctx, "register", j.Localpart(), j.Domainpart(), pass)(cmd)
+		if err != nil {
+			return err
+		}
+		return integration.User(j, pass)(cmd)
+	}
+}
+
+// Modules adds custom modules to the enabled modules list.
+func Modules(mod ...string) integration.Option {
+	return func(cmd *integration.Cmd) error {
+		cfg := getConfig(cmd)
+		cfg.Modules = append(cfg.Modules, mod...)
+		cmd.Config = cfg
+		return nil
+	}
+}
+
+// TrustAll configures ejabberd to trust all certificates presented to it
+// without any verification.
+//
+// It does this the same way mod_trustall does it for Prosody: by loading a
+// small custom module that always reports presented certificates as valid,
+// combined with making STARTTLS optional on s2s so that connections are not
+// rejected for not offering a cert to verify in the first place.
+func TrustAll() integration.Option {
+	const modName = "mod_trustall"
+	return func(cmd *integration.Cmd) error {
+		cfg := getConfig(cmd)
+		cfg.S2SUseStarttls = "optional"
+		cmd.Config = cfg
+		err := Modules(modName)(cmd)
+		if err != nil {
+			return err
+		}
+		return integration.TempFile(modName+".erl", func(_ *integration.Cmd, w io.Writer) error {
+			_, err := io.WriteString(w, `-module(mod_trustall).
+-behaviour(gen_mod).
+
+-export([start/2, stop/1, mod_opt_type/1, depends/2, mod_options/1]).
+-export([s2s_in_handshake/3]).
+
+start(Host, _Opts) ->
+	ejabberd_hooks:add(s2s_in_handshake, Host, ?MODULE, s2s_in_handshake, 10).
+
+stop(Host) ->
+	ejabberd_hooks:delete(s2s_in_handshake, Host, ?MODULE, s2s_in_handshake, 10).
+
+%% Always report the peer certificate as verified, mirroring Prosody's
+%% mod_trustall s2s-check-certificate hook.
+s2s_in_handshake(Acc, _StateData, _StreamMgmtID) ->
+	maps:put(cert_verify_result, ok, Acc).
+
+depends(_Host, _Opts) -> [].
+mod_opt_type(_) -> [].
+mod_options(_Host) -> [].
+`)
+			return err
+		})(cmd)
+	}
+}
+
+func defaultConfig(cmd *integration.Cmd) error {
+	for _, arg := range cmd.Cmd.Args {
+		if arg == configFlag {
+			return nil
+		}
+	}
+
+	cfg := getConfig(cmd)
+	if len(cfg.VHosts) == 0 {
+		const vhost = "localhost"
+		cfg.VHosts = append(cfg.VHosts, vhost)
+		err := integration.Cert(vhost)(cmd)
+		if err != nil {
+			return err
+		}
+	}
+	cmd.Config = cfg
+	if j, _ := cmd.User(); j.Equal(jid.JID{}) {
+		err := CreateUser(context.TODO(), "me@"+cfg.VHosts[0], "password")(cmd)
+		if err != nil {
+			return err
+		}
+	}
+
+	return ConfigFile(cfg)(cmd)
+}
+
+// Test starts an ejabberd instance and returns a function that runs subtests
+// using t.Run.
+// Multiple calls to the returned function will result in uniquely named
+// subtests.
+// When all subtests have completed, the daemon is stopped.
+func Test(ctx context.Context, t *testing.T, opts ...integration.Option) integration.SubtestRunner {
+	opts = append(opts, defaultConfig, integration.Args("foreground"))
+	return integration.Test(ctx, cmdName, t, opts...)
+}
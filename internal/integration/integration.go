@@ -0,0 +1,303 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package integration provides functionality for writing tests that run
+// against real XMPP servers instead of mocks.
+package integration // import "mellium.im/xmpp/internal/integration"
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/component"
+	"mellium.im/xmpp/jid"
+)
+
+const readySocketName = "ready.sock"
+
+// Cmd is a process that is being run as part of an integration test.
+type Cmd struct {
+	Cmd    *exec.Cmd
+	Config interface{}
+
+	dir  string
+	jid  jid.JID
+	pass string
+
+	certs []tls.Certificate
+	pool  *x509.CertPool
+
+	defers []func(*Cmd) error
+
+	readyListener net.Listener
+	// C2SAddr, S2SAddr, and ComponentAddr are populated from the readiness
+	// handshake (see ReadySocket) once the daemon reports that it has actually
+	// bound its c2s, s2s, and/or external component listeners.
+	C2SAddr       string
+	S2SAddr       string
+	ComponentAddr string
+}
+
+// Option is used to configure a Cmd.
+type Option func(*Cmd) error
+
+// New creates a new, unstarted command that can be used to run an XMPP
+// server (or other daemon) for integration testing.
+//
+// The provided context is used to kill the process (by calling
+// os.Process.Kill) if the context becomes done before the command completes
+// on its own.
+func New(ctx context.Context, name string, opts ...Option) (*Cmd, error) {
+	dir, err := os.MkdirTemp("", "xmpp-"+name)
+	if err != nil {
+		return nil, err
+	}
+
+	/* #nosec */
+	cmd := &Cmd{
+		Cmd: exec.CommandContext(ctx, name),
+		dir: dir,
+	}
+	for _, opt := range opts {
+		if err := opt(cmd); err != nil {
+			return nil, err
+		}
+	}
+	return cmd, nil
+}
+
+// ConfigDir returns the temporary directory created for this command's
+// configuration and other runtime files.
+func (cmd *Cmd) ConfigDir() string {
+	return cmd.dir
+}
+
+// User returns the JID and password of the user configured with the User
+// option (or the zero JID if no user has been configured).
+func (cmd *Cmd) User() (jid.JID, string) {
+	return cmd.jid, cmd.pass
+}
+
+// User returns an option that associates a user and password with the
+// command so that tests can look it up later.
+func User(j jid.JID, pass string) Option {
+	return func(cmd *Cmd) error {
+		cmd.jid = j
+		cmd.pass = pass
+		return nil
+	}
+}
+
+// Args appends raw arguments to the command being run.
+func Args(args ...string) Option {
+	return func(cmd *Cmd) error {
+		cmd.Cmd.Args = append(cmd.Cmd.Args, args...)
+		return nil
+	}
+}
+
+// Defer registers a function that Start runs once the process has started
+// (and, if a ready socket is in use, once the daemon has reported ready).
+// Functions registered after Start has returned are not run.
+func Defer(f func(*Cmd) error) Option {
+	return func(cmd *Cmd) error {
+		cmd.defers = append(cmd.defers, f)
+		return nil
+	}
+}
+
+// TempFile creates a file in the command's temporary config directory and
+// calls f to populate it.
+func TempFile(name string, f func(*Cmd, io.Writer) error) Option {
+	return func(cmd *Cmd) error {
+		file, err := os.Create(cmd.dir + string(os.PathSeparator) + name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return f(cmd, file)
+	}
+}
+
+// Cert generates a self-signed certificate for the given name and writes it
+// to the command's temporary config directory.
+func Cert(name string) Option {
+	return func(cmd *Cmd) error {
+		cert, err := selfSigned(name)
+		if err != nil {
+			return fmt.Errorf("integration: error generating cert for %s: %w", name, err)
+		}
+		cmd.certs = append(cmd.certs, cert)
+		return writeCert(cmd, name, cert)
+	}
+}
+
+// ReadySocket creates (if it does not already exist) the Unix domain socket
+// used for the daemon's startup readiness handshake and returns its path.
+//
+// Daemon packages pass this path to the server being configured (eg. as
+// Prosody's ready_socket option) alongside a small bundled module that
+// connects back to the socket once the server has started and reports the
+// ports it actually bound. Start then blocks until that message arrives and
+// populates C2SAddr/S2SAddr, which avoids the race inherent in picking a free
+// port, closing it, and hoping the daemon binds the same port before another
+// process grabs it.
+func (cmd *Cmd) ReadySocket() (string, error) {
+	if cmd.readyListener == nil {
+		l, err := net.Listen("unix", filepath.Join(cmd.dir, readySocketName))
+		if err != nil {
+			return "", err
+		}
+		cmd.readyListener = l
+	}
+	return cmd.readyListener.Addr().String(), nil
+}
+
+// Start starts the underlying command, running any deferred options once the
+// process has started.
+func (cmd *Cmd) Start(ctx context.Context) error {
+	if err := cmd.Cmd.Start(); err != nil {
+		return err
+	}
+	if cmd.readyListener != nil {
+		if err := cmd.waitReady(ctx); err != nil {
+			return err
+		}
+	}
+	for _, f := range cmd.defers {
+		if err := f(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitReady blocks until the daemon connects to the readiness socket and
+// reports the ports it bound, or until ctx is canceled.
+func (cmd *Cmd) waitReady(ctx context.Context) error {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	acceptC := make(chan result, 1)
+	go func() {
+		conn, err := cmd.readyListener.Accept()
+		acceptC <- result{conn, err}
+	}()
+
+	var res result
+	select {
+	case <-ctx.Done():
+		cmd.readyListener.Close()
+		return ctx.Err()
+	case res = <-acceptC:
+	}
+	if res.err != nil {
+		return res.err
+	}
+	defer res.conn.Close()
+
+	scanner := bufio.NewScanner(res.conn)
+	for scanner.Scan() {
+		proto, addr, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		switch proto {
+		case "c2s":
+			cmd.C2SAddr = addr
+		case "s2s":
+			cmd.S2SAddr = addr
+		case "component":
+			cmd.ComponentAddr = addr
+		}
+	}
+	return scanner.Err()
+}
+
+// Close stops the underlying command and removes its temporary config
+// directory.
+func (cmd *Cmd) Close() error {
+	defer os.RemoveAll(cmd.dir)
+	if cmd.readyListener != nil {
+		cmd.readyListener.Close()
+	}
+	if cmd.Cmd.Process == nil {
+		return nil
+	}
+	return cmd.Cmd.Process.Kill()
+}
+
+// ComponentLocator is implemented by a Cmd's Config when the daemon supports
+// external components (XEP-0114) added with an option such as
+// prosody.Component. It reports the shared secret registered for subdomain;
+// the dial address itself is only known once the daemon reports it actually
+// bound the listener (see ComponentAddr).
+type ComponentLocator interface {
+	Component(subdomain string) (secret string, ok bool)
+}
+
+// DialComponent looks up the component registered under subdomain (for
+// example with prosody.Component), performs the XEP-0114 handshake, and
+// returns a session bound as that component.
+func (cmd *Cmd) DialComponent(ctx context.Context, subdomain string) (*xmpp.Session, error) {
+	locator, ok := cmd.Config.(ComponentLocator)
+	if !ok {
+		return nil, fmt.Errorf("integration: %T does not support components", cmd.Config)
+	}
+	secret, ok := locator.Component(subdomain)
+	if !ok {
+		return nil, fmt.Errorf("integration: no component registered for %s", subdomain)
+	}
+	if cmd.ComponentAddr == "" {
+		return nil, fmt.Errorf("integration: component listener address is not yet known (was the daemon started?)")
+	}
+	conn, err := net.Dial("tcp", cmd.ComponentAddr)
+	if err != nil {
+		return nil, err
+	}
+	j, err := jid.Parse(subdomain)
+	if err != nil {
+		return nil, err
+	}
+	return component.NewSession(ctx, j, secret, conn)
+}
+
+// SubtestRunner is returned by Test and can be called the same way t.Run is
+// called to run subtests against the configured daemon.
+type SubtestRunner func(string, func(*testing.T, *Cmd)) bool
+
+// Test starts the named command and returns a function that can be used to
+// run subtests against it using t.Run.
+// When all subtests have completed, the daemon is stopped.
+func Test(ctx context.Context, name string, t *testing.T, opts ...Option) SubtestRunner {
+	cmd, err := New(ctx, name, opts...)
+	if err != nil {
+		t.Fatalf("integration: error creating command %s: %v", name, err)
+	}
+	if err := cmd.Start(ctx); err != nil {
+		t.Fatalf("integration: error starting command %s: %v", name, err)
+	}
+	t.Cleanup(func() {
+		if err := cmd.Close(); err != nil {
+			t.Logf("integration: error shutting down %s: %v", name, err)
+		}
+	})
+	return func(name string, f func(*testing.T, *Cmd)) bool {
+		return t.Run(name, func(t *testing.T) {
+			f(t, cmd)
+		})
+	}
+}
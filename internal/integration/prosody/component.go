@@ -0,0 +1,95 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package prosody
+
+import "mellium.im/xmpp/internal/integration"
+
+// ComponentConfig holds the Prosody-side configuration for a single component
+// attached to the harness with Component, MUCComponent, PubSubComponent, or
+// ProxyComponent.
+type ComponentConfig struct {
+	Subdomain string
+	Secret    string
+	Modules   []string
+
+	// Plugin is set for internal components (eg. "muc", "pubsub", or
+	// "proxy65") loaded with Prosody's two-string Component shorthand instead
+	// of the external XEP-0114 handshake used by Secret-based components; see
+	// Component vs MUCComponent/PubSubComponent/ProxyComponent.
+	Plugin string
+}
+
+// ComponentOption configures a ComponentConfig registered with Component.
+type ComponentOption func(*ComponentConfig)
+
+// ComponentModules adds modules to the enabled modules list of the component
+// it is passed to, analogous to the top-level Modules option.
+func ComponentModules(mod ...string) ComponentOption {
+	return func(cfg *ComponentConfig) {
+		cfg.Modules = append(cfg.Modules, mod...)
+	}
+}
+
+// Component reserves the shared external component listener (on the first
+// call; subsequent components reuse the same listener as Prosody expects)
+// and appends a Component block to the generated config so that a component
+// can connect and authenticate with secret over XEP-0114.
+//
+// Like ListenC2S and ListenS2S, the listener's port is picked by Prosody
+// itself and reported back through the readiness handshake (mod_ready)
+// rather than being grabbed and closed ahead of time, so there is no window
+// in which another process can steal the port.
+//
+// Once the daemon is running, dial the component with
+// cmd.DialComponent(ctx, subdomain). For Prosody's own built-in components
+// (MUC, PubSub, SOCKS5 proxy) use MUCComponent, PubSubComponent, or
+// ProxyComponent instead, which load the module in-process rather than
+// requiring it to dial in over XEP-0114.
+func Component(subdomain, secret string, opts ...ComponentOption) integration.Option {
+	return func(cmd *integration.Cmd) error {
+		cfg := getConfig(cmd)
+		cfg.ComponentEnabled = true
+
+		compCfg := ComponentConfig{Subdomain: subdomain, Secret: secret}
+		for _, opt := range opts {
+			opt(&compCfg)
+		}
+		cfg.Components = append(cfg.Components, compCfg)
+		cmd.Config = cfg
+		return installReady(cmd)
+	}
+}
+
+// internalComponent registers one of Prosody's built-in components (mod_muc,
+// mod_pubsub, mod_proxy65, …) using the two-string Component shorthand
+// ( Component "name" "plugin" ), which loads the module in-process under that
+// subdomain. Unlike Component, this never starts the external XEP-0114
+// listener and has no secret to dial with.
+func internalComponent(subdomain, plugin string) integration.Option {
+	return func(cmd *integration.Cmd) error {
+		cfg := getConfig(cmd)
+		cfg.Components = append(cfg.Components, ComponentConfig{Subdomain: subdomain, Plugin: plugin})
+		cmd.Config = cfg
+		return nil
+	}
+}
+
+// MUCComponent attaches a Multi-User Chat (XEP-0045) component under
+// subdomain, loading Prosody's internal mod_muc.
+func MUCComponent(subdomain string) integration.Option {
+	return internalComponent(subdomain, "muc")
+}
+
+// PubSubComponent attaches a publish-subscribe (XEP-0060) component under
+// subdomain, loading Prosody's internal mod_pubsub.
+func PubSubComponent(subdomain string) integration.Option {
+	return internalComponent(subdomain, "pubsub")
+}
+
+// ProxyComponent attaches a SOCKS5 file transfer proxy (XEP-0065) component
+// under subdomain, loading Prosody's internal mod_proxy65.
+func ProxyComponent(subdomain string) integration.Option {
+	return internalComponent(subdomain, "proxy65")
+}
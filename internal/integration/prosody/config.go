@@ -0,0 +1,174 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package prosody
+
+import "text/template"
+
+// Config contains options that can be written to a Prosody config file.
+type Config struct {
+	VHosts  []string
+	Modules []string
+
+	// C2SEnabled and S2SEnabled report whether ListenC2S/ListenS2S were used.
+	// C2SPort/S2SPort are 0 unless a fixed port was requested (eg. by the
+	// federation harness, which must know the port before the daemon starts);
+	// otherwise Prosody is told to pick a free port itself and the port it
+	// actually bound is reported back through ReadySocket.
+	C2SEnabled bool
+	S2SEnabled bool
+	C2SPort    int
+	S2SPort    int
+
+	// ReadySocket is the path to the Unix domain socket that mod_ready
+	// connects back to once Prosody has started.
+	ReadySocket string
+
+	MAM        *MAMConfig
+	Disco      []DiscoItem
+	HTTPUpload *HTTPUploadConfig
+	BOSH       *BOSHConfig
+	Websocket  *WSConfig
+
+	TLS            *TLSConfig
+	PerHostTLS     map[string]TLSConfig
+	ClientCertAuth string
+	RequireC2SEnc  bool
+	RequireS2SEnc  bool
+
+	// ComponentEnabled reports whether Component (or a preset built on it) has
+	// reserved the shared external component listener. As with C2SEnabled and
+	// S2SEnabled, Prosody is told to pick a free port itself, and the port it
+	// actually bound is reported back through ReadySocket into cmd.ComponentAddr.
+	ComponentEnabled bool
+	Components       []ComponentConfig
+}
+
+// Component returns the shared secret of the external (XEP-0114) component
+// registered under subdomain, if any, satisfying integration.ComponentLocator.
+// Internal components (eg. those registered by MUCComponent) have no secret
+// to dial with and are never matched here.
+func (c Config) Component(subdomain string) (secret string, ok bool) {
+	for _, comp := range c.Components {
+		if comp.Subdomain == subdomain && comp.Plugin == "" {
+			return comp.Secret, true
+		}
+	}
+	return "", false
+}
+
+// TLSFor returns the TLS configuration that applies to host, preferring a
+// config registered with PerHostTLS over the vhost-wide config set with TLS.
+func (c Config) TLSFor(host string) *TLSConfig {
+	if cfg, ok := c.PerHostTLS[host]; ok {
+		return &cfg
+	}
+	return c.TLS
+}
+
+// MAMConfig contains options for configuring mod_mam (XEP-0313: Message
+// Archive Management).
+type MAMConfig struct {
+	// Default is the default archiving policy ("always", "never", or
+	// "roster").
+	Default string
+}
+
+// DiscoItem is a service discovery item advertised under disco_items.
+type DiscoItem struct {
+	URL         string
+	Description string
+}
+
+// HTTPUploadConfig contains options for configuring mod_http_upload
+// (XEP-0363: HTTP File Upload).
+type HTTPUploadConfig struct {
+	FileSizeLimit int64
+	ExpireAfter   int64
+}
+
+// BOSHConfig contains options for configuring mod_bosh (XEP-0124: Bidirectional
+// streams Over Synchronous HTTP).
+type BOSHConfig struct {
+	Path        string
+	CrossDomain bool
+}
+
+// WSConfig contains options for configuring mod_websocket (RFC 7395: XMPP
+// Subprotocol for WebSocket).
+type WSConfig struct {
+	Path        string
+	CrossDomain bool
+}
+
+var cfgTmpl = template.Must(template.New(cfgFileName).Parse(`
+pidfile = "{{.ConfigDir}}/prosody.pid"
+data_path = "{{.ConfigDir}}"
+
+{{if .C2SEnabled}}c2s_ports = { {{.C2SPort}} }
+c2s_interfaces = { "127.0.0.1", "::1" }
+{{end}}
+{{if .S2SEnabled}}s2s_ports = { {{.S2SPort}} }
+s2s_interfaces = { "127.0.0.1", "::1" }
+{{end}}
+{{if .ReadySocket}}ready_socket = "{{.ReadySocket}}"{{end}}
+
+modules_enabled = {
+{{range .Modules}}	"{{.}}";
+{{end}}}
+
+{{if .MAM}}default_archive_policy = "{{.MAM.Default}}"
+{{end}}
+{{if .Disco}}disco_items = {
+{{range .Disco}}	{ "{{.URL}}", "{{.Description}}" };
+{{end}}}
+{{end}}
+{{if .HTTPUpload}}http_upload_file_size_limit = {{.HTTPUpload.FileSizeLimit}}
+http_upload_expire_after = {{.HTTPUpload.ExpireAfter}}
+{{end}}
+{{if .BOSH}}bosh_cross_domain = {{.BOSH.CrossDomain}}
+{{end}}
+{{if .Websocket}}cross_domain_websocket = {{.Websocket.CrossDomain}}
+{{end}}
+{{if or (and .BOSH .BOSH.Path) (and .Websocket .Websocket.Path)}}http_paths = {
+{{if and .BOSH .BOSH.Path}}	bosh = "{{.BOSH.Path}}";
+{{end}}{{if and .Websocket .Websocket.Path}}	websocket = "{{.Websocket.Path}}";
+{{end}}}
+{{end}}
+
+{{if .RequireC2SEnc}}c2s_require_encryption = true{{end}}
+{{if .RequireS2SEnc}}s2s_require_encryption = true{{end}}
+{{if .ClientCertAuth}}authentication = "certificate"
+{{end}}
+
+{{if .ComponentEnabled}}component_ports = { 0 }
+component_interfaces = { "127.0.0.1", "::1" }
+{{end}}
+{{range .Components}}
+{{if .Plugin}}Component "{{.Subdomain}}" "{{.Plugin}}"
+{{else}}Component "{{.Subdomain}}"
+	component_secret = "{{.Secret}}"
+{{if .Modules}}	modules_enabled = { {{range .Modules}}"{{.}}"; {{end}}}
+{{end}}{{end}}{{end}}
+
+{{range .VHosts}}
+{{$tls := $.TLSFor .}}
+VirtualHost "{{.}}"
+	ssl = {
+{{if and $tls $tls.Key}}		key = "{{$tls.Key}}";
+		certificate = "{{$tls.Certificate}}";
+{{else}}		key = "{{$.ConfigDir}}/{{.}}.key";
+		certificate = "{{$.ConfigDir}}/{{.}}.crt";
+{{end}}{{with $tls}}{{if .CAFile}}		cafile = "{{.CAFile}}";
+{{end}}{{if .CAPath}}		capath = "{{.CAPath}}";
+{{end}}{{if .Ciphers}}		ciphers = "{{.Ciphers}}";
+{{end}}{{if .Protocol}}		protocol = "{{.Protocol}}";
+{{end}}{{if .DHParam}}		dhparam = "{{.DHParam}}";
+{{end}}{{if .VerifyMode}}		verify = "{{.VerifyMode}}";
+{{end}}{{if .Options}}		options = { {{range .Options}}"{{.}}"; {{end}}};
+{{end}}{{end}}{{if $.ClientCertAuth}}		cafile = "{{$.ClientCertAuth}}";
+		verify = "peer";
+{{end}}	}
+{{end}}
+`))
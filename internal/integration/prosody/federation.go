@@ -0,0 +1,222 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package prosody
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"mellium.im/sasl"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/internal/integration"
+	"mellium.im/xmpp/jid"
+)
+
+// FederationNode describes a single Prosody instance to start as part of a
+// Federation.
+type FederationNode struct {
+	// VHost is the virtual host that this node is authoritative for.
+	VHost string
+	// Opts are additional options used to configure this node, for example to
+	// add modules or create users.
+	Opts []integration.Option
+}
+
+// Fed is a group of Prosody instances that have been configured to federate
+// with one another over s2s for testing.
+type Fed struct {
+	nodes map[string]*integration.Cmd
+}
+
+// Federate starts one Prosody instance per node, statically resolving each
+// node's vhost to the s2s listener of the matching instance (so that s2s
+// connections never hit the real network or DNS). Each node's self-signed
+// certificate is cross-installed into every other node's CA bundle, s2s is
+// required to be encrypted, and peers are verified against that bundle, so
+// that a verification failure aborts the s2s connection instead of silently
+// falling back to plaintext or an unverified handshake.
+//
+// It returns one integration.SubtestRunner per node, in the same order as
+// nodes, along with a Fed that can be used to dial client sessions against
+// any of the federated vhosts.
+func Federate(ctx context.Context, t *testing.T, nodes []FederationNode) ([]integration.SubtestRunner, *Fed) {
+	t.Helper()
+
+	// Unlike the single-daemon case (see ListenS2S), every node's s2s port
+	// must be known before any node starts so that the other nodes' resolver
+	// modules can be configured with it up front. So the ports are reserved
+	// here the old-fashioned (racy, but good enough to hand out before any of
+	// these processes exist) way instead of going through the readiness
+	// protocol.
+	ports := make(map[string]int, len(nodes))
+	// Likewise, every node needs every other node's certificate before any of
+	// them start, so the certs are generated up front with GenCert and cross
+	// installed below instead of being generated lazily by integration.Cert.
+	certs := make(map[string]tls.Certificate, len(nodes))
+	for _, node := range nodes {
+		port, err := reservePort()
+		if err != nil {
+			t.Fatalf("prosody: error reserving s2s port for %s: %v", node.VHost, err)
+		}
+		ports[node.VHost] = port
+
+		cert, err := integration.GenCert(node.VHost)
+		if err != nil {
+			t.Fatalf("prosody: error generating cert for %s: %v", node.VHost, err)
+		}
+		certs[node.VHost] = cert
+	}
+
+	fed := &Fed{nodes: make(map[string]*integration.Cmd)}
+	runners := make([]integration.SubtestRunner, 0, len(nodes))
+
+	for _, node := range nodes {
+		opts := append([]integration.Option{
+			VHost(node.VHost),
+			integration.UseCert(node.VHost, certs[node.VHost]),
+			ListenC2S(),
+			s2sFixedPort(ports[node.VHost]),
+			trustCerts(node.VHost, certs),
+			RequireEncryption(false, true),
+			resolveVHosts(ports),
+		}, node.Opts...)
+		runner := Test(ctx, t, opts...)
+		runners = append(runners, runner)
+
+		// Test blocks until the instance is started and registers its own
+		// cleanup, but we still need a handle to the running Cmd so that Dial
+		// can look up the right c2s address later. Run a no-op subtest purely to
+		// get a reference to the underlying Cmd.
+		runner(node.VHost+"/setup", func(_ *testing.T, cmd *integration.Cmd) {
+			fed.nodes[node.VHost] = cmd
+		})
+	}
+
+	return runners, fed
+}
+
+// trustCerts writes every federated node's certificate other than vhost's own
+// into a CA bundle and configures vhost's TLS settings to verify peers
+// against it, so that s2s connections from the other federated nodes are
+// cryptographically verified rather than blindly trusted.
+func trustCerts(vhost string, certs map[string]tls.Certificate) integration.Option {
+	const caFileName = "fed_ca.crt"
+	return func(cmd *integration.Cmd) error {
+		err := integration.TempFile(caFileName, func(_ *integration.Cmd, w io.Writer) error {
+			for peer, cert := range certs {
+				if peer == vhost {
+					continue
+				}
+				err := pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})(cmd)
+		if err != nil {
+			return err
+		}
+		return TLS(TLSConfig{
+			CAFile:     fmt.Sprintf("%s/%s", cmd.ConfigDir(), caFileName),
+			VerifyMode: "peer",
+		})(cmd)
+	}
+}
+
+// reservePort grabs a free TCP port and immediately releases it so that it
+// can be handed out to a Prosody instance that doesn't exist yet.
+func reservePort() (int, error) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		return 0, err
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	return port, l.Close()
+}
+
+// s2sFixedPort pins s2s to a specific, already-reserved port instead of
+// letting Prosody pick one, for the rare case (federation) where every node
+// needs to know another node's port before that node has started.
+func s2sFixedPort(port int) integration.Option {
+	return func(cmd *integration.Cmd) error {
+		cfg := getConfig(cmd)
+		cfg.S2SEnabled = true
+		cfg.S2SPort = port
+		cmd.Config = cfg
+		return installReady(cmd)
+	}
+}
+
+// resolveVHosts returns an option that installs a small Prosody module
+// hooking "s2s-resolve-host" so that outgoing s2s connections to any of the
+// federated vhosts are resolved directly to that node's s2s port on
+// localhost, bypassing DNS and SRV lookups entirely.
+func resolveVHosts(ports map[string]int) integration.Option {
+	return func(cmd *integration.Cmd) error {
+		err := Modules("fed_resolver")(cmd)
+		if err != nil {
+			return err
+		}
+		return integration.TempFile("mod_fed_resolver.lua", func(_ *integration.Cmd, w io.Writer) error {
+			_, err := io.WriteString(w, `
+module:set_global();
+
+local targets = {
+`)
+			if err != nil {
+				return err
+			}
+			for vhost, port := range ports {
+				_, err = fmt.Fprintf(w, "\t[%q] = { host = \"127.0.0.1\", port = %d };\n", vhost, port)
+				if err != nil {
+					return err
+				}
+			}
+			_, err = io.WriteString(w, `};
+
+module:hook("s2s-resolve-host", function(event)
+	local target = targets[event.host];
+	if not target then
+		return;
+	end
+	event.resolved = true;
+	event.targets = { { type = "A", target = target.host, priority = 0, weight = 0, port = target.port } };
+	return true;
+end);`)
+			return err
+		})(cmd)
+	}
+}
+
+// Dial starts a client session as j (authenticating with pass) against the
+// federated node that owns j's domain, ready to send stanzas to any other
+// vhost in the federation.
+func (f *Fed) Dial(ctx context.Context, j jid.JID, pass string) (*xmpp.Session, error) {
+	cmd, ok := f.nodes[j.Domainpart()]
+	if !ok {
+		return nil, fmt.Errorf("prosody: no federated node for vhost %s", j.Domainpart())
+	}
+	conn, err := net.Dial("tcp", cmd.C2SAddr)
+	if err != nil {
+		return nil, err
+	}
+	return xmpp.NewSession(
+		ctx, j.Domain(), j, conn,
+		0,
+		xmpp.NewNegotiator(xmpp.StreamConfig{
+			Features: []xmpp.StreamFeature{
+				xmpp.BindResource(),
+				xmpp.SASL("", pass, sasl.Plain),
+				xmpp.StartTLS(&tls.Config{InsecureSkipVerify: true}),
+			},
+		}),
+	)
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package prosody
+
+import (
+	"fmt"
+
+	"mellium.im/xmpp/internal/integration"
+)
+
+// Carbons enables mod_carbons (XEP-0280: Message Carbons).
+func Carbons() integration.Option {
+	return Modules("carbons")
+}
+
+// Roster enables mod_roster, the module responsible for roster (contact
+// list) management.
+func Roster() integration.Option {
+	return Modules("roster")
+}
+
+// Ping enables mod_ping (XEP-0199: XMPP Ping).
+func Ping() integration.Option {
+	return Modules("ping")
+}
+
+// MAM enables mod_mam (XEP-0313: Message Archive Management) and configures
+// its default archiving policy.
+func MAM(cfg MAMConfig) integration.Option {
+	return func(cmd *integration.Cmd) error {
+		c := getConfig(cmd)
+		c.MAM = &cfg
+		cmd.Config = c
+		return Modules("mam")(cmd)
+	}
+}
+
+// Disco adds items to the vhost's service discovery items list.
+func Disco(items ...DiscoItem) integration.Option {
+	return func(cmd *integration.Cmd) error {
+		cfg := getConfig(cmd)
+		cfg.Disco = append(cfg.Disco, items...)
+		cmd.Config = cfg
+		return Modules("disco")(cmd)
+	}
+}
+
+// HTTPUpload enables mod_http_upload (XEP-0363: HTTP File Upload).
+func HTTPUpload(cfg HTTPUploadConfig) integration.Option {
+	return func(cmd *integration.Cmd) error {
+		c := getConfig(cmd)
+		c.HTTPUpload = &cfg
+		cmd.Config = c
+		return Modules("http_upload")(cmd)
+	}
+}
+
+// BOSH enables mod_bosh (XEP-0124: Bidirectional streams Over Synchronous
+// HTTP).
+func BOSH(cfg BOSHConfig) integration.Option {
+	return func(cmd *integration.Cmd) error {
+		c := getConfig(cmd)
+		c.BOSH = &cfg
+		cmd.Config = c
+		return Modules("bosh")(cmd)
+	}
+}
+
+// Websocket enables mod_websocket (RFC 7395: XMPP Subprotocol for
+// WebSocket).
+func Websocket(cfg WSConfig) integration.Option {
+	return func(cmd *integration.Cmd) error {
+		c := getConfig(cmd)
+		c.Websocket = &cfg
+		cmd.Config = c
+		return Modules("websocket")(cmd)
+	}
+}
+
+// complianceModules maps an XMPP compliance suite name to the set of modules
+// required to satisfy it.
+//
+// See https://xmpp.org/extensions/xep-0479.html (and its yearly predecessors)
+// for the module-independent compliance suite definitions that these module
+// sets attempt to satisfy under Prosody.
+var complianceModules = map[string][]string{
+	"conversations-2022": {
+		"carbons",
+		"mam",
+		"http_upload",
+		"smacks",
+		"csi",
+		"blocklist",
+	},
+}
+
+// Compliance enables the set of modules required to satisfy the named XMPP
+// compliance suite (for example "conversations-2022").
+// It panics if level is not a known compliance suite, since this always
+// indicates a mistake in the calling test.
+func Compliance(level string) integration.Option {
+	mods, ok := complianceModules[level]
+	if !ok {
+		panic(fmt.Sprintf("prosody: unknown compliance suite %q", level))
+	}
+	return Modules(mods...)
+}
@@ -8,7 +8,6 @@ package prosody // import "mellium.im/xmpp/internal/integration/prosody"
 import (
 	"context"
 	"io"
-	"net"
 	"os/exec"
 	"path/filepath"
 	"testing"
@@ -81,55 +80,27 @@ func getConfig(cmd *integration.Cmd) Config {
 	return cmd.Config.(Config)
 }
 
-// ListenC2S listens for client-to-server (c2s) connections on a random port.
+// ListenC2S listens for client-to-server (c2s) connections.
+// Prosody is told to bind a free port itself and report back which port it
+// chose; see mod_ready.
 func ListenC2S() integration.Option {
 	return func(cmd *integration.Cmd) error {
-		c2sListener, err := cmd.C2SListen("tcp", "[::1]:0")
-		if err != nil {
-			return err
-		}
-		// Prosody creates its own sockets and doesn't provide us with a way of
-		// pointing it at an existing Unix domain socket or handing the filehandle for
-		// the TCP connection to it on start, so we're effectively just listening to
-		// get a random port that we'll use to configure Prosody, then we need to
-		// close the connection and let Prosody listen on that port.
-		// Technically this is racey, but it's not likely to be a problem in practice.
-		c2sPort := c2sListener.Addr().(*net.TCPAddr).Port
-		err = c2sListener.Close()
-		if err != nil {
-			return err
-		}
-
 		cfg := getConfig(cmd)
-		cfg.C2SPort = c2sPort
+		cfg.C2SEnabled = true
 		cmd.Config = cfg
-		return nil
+		return installReady(cmd)
 	}
 }
 
-// ListenS2S listens for server-to-server (s2s) connections on a random port.
+// ListenS2S listens for server-to-server (s2s) connections.
+// Prosody is told to bind a free port itself and report back which port it
+// chose; see mod_ready.
 func ListenS2S() integration.Option {
 	return func(cmd *integration.Cmd) error {
-		s2sListener, err := cmd.S2SListen("tcp", "[::1]:0")
-		if err != nil {
-			return err
-		}
-		// Prosody creates its own sockets and doesn't provide us with a way of
-		// pointing it at an existing Unix domain socket or handing the filehandle for
-		// the TCP connection to it on start, so we're effectively just listening to
-		// get a random port that we'll use to configure Prosody, then we need to
-		// close the connection and let Prosody listen on that port.
-		// Technically this is racey, but it's not likely to be a problem in practice.
-		s2sPort := s2sListener.Addr().(*net.TCPAddr).Port
-		err = s2sListener.Close()
-		if err != nil {
-			return err
-		}
-
 		cfg := getConfig(cmd)
-		cfg.S2SPort = s2sPort
+		cfg.S2SEnabled = true
 		cmd.Config = cfg
-		return nil
+		return installReady(cmd)
 	}
 }
 
@@ -201,6 +172,71 @@ end);`)
 	}
 }
 
+// installReady ensures the ready socket exists, records its path in the
+// config, and installs the bundled mod_ready that reports back the ports
+// Prosody actually bound once it has started.
+func installReady(cmd *integration.Cmd) error {
+	cfg := getConfig(cmd)
+	if cfg.ReadySocket == "" {
+		path, err := cmd.ReadySocket()
+		if err != nil {
+			return err
+		}
+		cfg.ReadySocket = path
+		cmd.Config = cfg
+		err = Modules("ready")(cmd)
+		if err != nil {
+			return err
+		}
+	}
+	return integration.TempFile("mod_ready.lua", func(_ *integration.Cmd, w io.Writer) error {
+		_, err := io.WriteString(w, `
+local portmanager = require "core.portmanager";
+
+module:set_global();
+
+module:hook_global("server-started", function()
+	local ready_socket = module:get_option_string("ready_socket");
+	if not ready_socket then
+		return;
+	end
+	local socket = require "socket.unix"();
+	local ok, err = socket:connect(ready_socket);
+	if not ok then
+		module:log("error", "mod_ready: could not connect to %s: %s", ready_socket, err);
+		return;
+	end
+	for _, name in ipairs({ "c2s", "s2s", "component" }) do
+		local service = portmanager.get_active_services():get(name);
+		if service then
+			-- A service can be bound to more than one interface (eg. both
+			-- "127.0.0.1" and "::1", since the config forces both to be
+			-- listened on). Report only one canonical, dialable address per
+			-- service rather than every interface: the caller has no way to
+			-- tell which of several reported addresses is connectable, and a
+			-- wildcard interface like "*" isn't dialable at all.
+			local chosen, chosen_port;
+			for interface, port in service:ports() do
+				if chosen == nil or interface == "127.0.0.1" or interface == "::1" then
+					chosen, chosen_port = interface, port;
+				end
+			end
+			if chosen then
+				-- Bracket IPv6 interfaces (eg. "::1") so the reported address is an
+				-- unambiguous host:port pair.
+				if chosen:find(":") then
+					chosen = "[" .. chosen .. "]";
+				end
+				socket:send(name .. " " .. chosen .. ":" .. chosen_port .. "\n");
+			end
+		end
+	end
+	socket:close();
+end);`)
+		return err
+	})(cmd)
+}
+
 func defaultConfig(cmd *integration.Cmd) error {
 	for _, arg := range cmd.Cmd.Args {
 		if arg == configFlag {
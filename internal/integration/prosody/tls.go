@@ -0,0 +1,100 @@
+// Copyright 2020 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package prosody
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+
+	"mellium.im/xmpp/internal/integration"
+)
+
+// TLSConfig mirrors Prosody's LuaSec "ssl" config block and can be used to
+// configure a vhost's TLS settings.
+type TLSConfig struct {
+	Key         string
+	Certificate string
+	CAFile      string
+	CAPath      string
+	Ciphers     string
+
+	// Protocol sets the minimum (and, with a trailing "+", the allowed range
+	// of) TLS protocol versions, eg. "tlsv1_2+".
+	Protocol string
+
+	DHParam string
+
+	// VerifyMode is one of "peer", "none", or "client_once".
+	VerifyMode string
+
+	// Options is a list of LuaSec SSL options such as "no_ticket" or
+	// "single_dh_use".
+	Options []string
+}
+
+// TLS configures the TLS settings of every vhost that has no PerHostTLS
+// override.
+func TLS(cfg TLSConfig) integration.Option {
+	return func(cmd *integration.Cmd) error {
+		c := getConfig(cmd)
+		c.TLS = &cfg
+		cmd.Config = c
+		return nil
+	}
+}
+
+// PerHostTLS configures TLS settings for a single vhost, overriding the
+// settings configured with TLS for that host.
+func PerHostTLS(host string, cfg TLSConfig) integration.Option {
+	return func(cmd *integration.Cmd) error {
+		c := getConfig(cmd)
+		if c.PerHostTLS == nil {
+			c.PerHostTLS = make(map[string]TLSConfig)
+		}
+		c.PerHostTLS[host] = cfg
+		cmd.Config = c
+		return nil
+	}
+}
+
+// ClientCertAuth enables SASL EXTERNAL by writing the provided CA pool to the
+// command's temp dir and configuring Prosody to authenticate client
+// certificates against it.
+func ClientCertAuth(caPool ...*x509.Certificate) integration.Option {
+	const caFileName = "client_ca.crt"
+	return func(cmd *integration.Cmd) error {
+		err := integration.TempFile(caFileName, func(_ *integration.Cmd, w io.Writer) error {
+			for _, cert := range caPool {
+				err := pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})(cmd)
+		if err != nil {
+			return err
+		}
+
+		c := getConfig(cmd)
+		c.ClientCertAuth = fmt.Sprintf("%s/%s", cmd.ConfigDir(), caFileName)
+		cmd.Config = c
+		return nil
+	}
+}
+
+// RequireEncryption toggles whether c2s and/or s2s connections are required
+// to be encrypted (ie. whether STARTTLS downgrade attacks are possible).
+func RequireEncryption(c2s, s2s bool) integration.Option {
+	return func(cmd *integration.Cmd) error {
+		c := getConfig(cmd)
+		c.RequireC2SEnc = c2s
+		c.RequireS2SEnc = s2s
+		cmd.Config = c
+		return nil
+	}
+}